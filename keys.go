@@ -2,9 +2,12 @@ package main
 
 import (
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
+
+	"golang.org/x/crypto/ed25519"
 )
 
 type Key struct {
@@ -19,12 +22,34 @@ type SignedKey struct {
 }
 
 type PreKeys struct {
-	signedPreKey  SignedKey `json:"signedKey"`
-	IdentityKey   string    `json:"identityKey`
+	SignedPreKey  SignedKey `json:"signedKey"`
+	IdentityKey   string    `json:"identityKey"`
 	LastResortKey Key       `json:"lastResortKey"`
 	Keys          []Key     `json:"keys"`
 }
 
+// verifySignedPreKey checks that preKeys.SignedPreKey.Signature is a valid
+// Ed25519 signature, by the identity key preKeys.IdentityKey, over the
+// signed prekey's public key.
+func verifySignedPreKey(preKeys *PreKeys) bool {
+	identity, err := base64.StdEncoding.DecodeString(preKeys.IdentityKey)
+	if err != nil || len(identity) != ed25519.PublicKeySize {
+		return false
+	}
+
+	signedPub, err := base64.StdEncoding.DecodeString(preKeys.SignedPreKey.PublicKey)
+	if err != nil {
+		return false
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(preKeys.SignedPreKey.Signature)
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(ed25519.PublicKey(identity), signedPub, signature)
+}
+
 func registerKeys(w http.ResponseWriter, req *http.Request) {
 	uname, _, ok := req.BasicAuth()
 	if !ok {
@@ -47,6 +72,11 @@ func registerKeys(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if !verifySignedPreKey(&preKeys) {
+		http.Error(w, "signed prekey does not verify", 400)
+		return
+	}
+
 	id := sha1.Sum([]byte(uname))
 
 	writeDB(id[:], []byte("k"), body)
@@ -0,0 +1,74 @@
+package panda
+
+import "testing"
+
+func TestArgon2idKDFDerive(t *testing.T) {
+	kdf := Argon2idKDF{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+	var out1, out2 [32]byte
+	if err := kdf.Derive([]byte("shared secret"), out1[:]); err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+	if err := kdf.Derive([]byte("shared secret"), out2[:]); err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+	if out1 != out2 {
+		t.Fatalf("Argon2idKDF.Derive is not deterministic for the same input")
+	}
+
+	var out3 [32]byte
+	if err := kdf.Derive([]byte("different secret"), out3[:]); err != nil {
+		t.Fatalf("Derive: %s", err)
+	}
+	if out1 == out3 {
+		t.Fatalf("Argon2idKDF.Derive produced the same output for different secrets")
+	}
+}
+
+func TestArgon2idKDFRejectsZeroParamsInsteadOfPanicking(t *testing.T) {
+	var out [32]byte
+
+	if err := (Argon2idKDF{}).Derive([]byte("secret"), out[:]); err == nil {
+		t.Fatalf("Derive with a zero-value Argon2idKDF did not error")
+	}
+	if err := (Argon2idKDF{Time: 1, Threads: 0}).Derive([]byte("secret"), out[:]); err == nil {
+		t.Fatalf("Derive with Threads: 0 did not error")
+	}
+	if err := (Argon2idKDF{Time: 0, Threads: 1}).Derive([]byte("secret"), out[:]); err == nil {
+		t.Fatalf("Derive with Time: 0 did not error")
+	}
+}
+
+func TestSharedSecretKDFParamsRoundTrip(t *testing.T) {
+	s := &SharedSecret{
+		Secret: "hello",
+		KDFParams: &Argon2idKDF{
+			Time:    3,
+			Memory:  64 * 1024,
+			Threads: 2,
+		},
+	}
+
+	round, ok := newSharedSecret(s.toProto())
+	if !ok {
+		t.Fatalf("newSharedSecret rejected a freshly-built proto")
+	}
+	if round.KDFParams == nil {
+		t.Fatalf("KDFParams did not survive the proto round trip")
+	}
+	if *round.KDFParams != *s.KDFParams {
+		t.Fatalf("KDFParams = %+v, want %+v", *round.KDFParams, *s.KDFParams)
+	}
+}
+
+func TestSharedSecretWithoutKDFParamsDefaultsToScrypt(t *testing.T) {
+	s := &SharedSecret{Secret: "hello"}
+
+	round, ok := newSharedSecret(s.toProto())
+	if !ok {
+		t.Fatalf("newSharedSecret rejected a freshly-built proto")
+	}
+	if round.KDFParams != nil {
+		t.Fatalf("KDFParams = %+v, want nil so derivePassword keeps using ScryptKDF", round.KDFParams)
+	}
+}
@@ -0,0 +1,255 @@
+package panda
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrNoMeetingPlaces is returned by MultiMeetingPlace.Exchange when Places
+// is empty.
+var ErrNoMeetingPlaces = errors.New("panda: no meeting places configured")
+
+// ErrQuorumNotReached is returned by MultiMeetingPlace.Exchange when no
+// single reply was returned by at least RequireQuorum backends and none of
+// the backends it contacted failed (a backend's error is returned instead).
+var ErrQuorumNotReached = errors.New("panda: failed to reach a quorum of meeting places")
+
+// MultiMeetingPlace is a MeetingPlace that fans a single Exchange call out
+// to several independent backends at once - for example two unrelated Pond
+// servers, a Tor onion service and an HTTPS relay, or a libp2p rendezvous
+// point - so that one meeting-place operator going offline can't stall a
+// key exchange. MultiMeetingPlace does not authenticate replies itself:
+// with the default quorum of one, whichever backend replies first wins and
+// its reply is remembered for retries, so a backend that answers first with
+// a forged or replayed message stalls the exchange. RequireQuorum makes a
+// reply count only when enough backends returned the same bytes.
+//
+// Because KeyExchange.Run retries a failed state by calling Exchange again
+// with the same id and message, MultiMeetingPlace remembers which backends
+// have already produced a reply for that id (see Reset) so that a retry
+// only contacts the backends that are still pending, rather than every
+// backend from scratch. That memory is only held in process; a caller that
+// needs Run to resume across a restart without recontacting
+// already-acknowledged backends must persist State() alongside
+// KeyExchange.Marshal() and call RestoreState on the fresh MultiMeetingPlace
+// it builds before resuming Run (see State).
+type MultiMeetingPlace struct {
+	// Places are the backends to fan Exchange out to. They must all
+	// agree on Padding(); Padding reports the first backend's value.
+	Places []MeetingPlace
+
+	// PerBackendTimeout bounds how long a single backend's Exchange call
+	// is given before it's treated as unreachable for this attempt. Zero
+	// means no per-backend timeout, only the caller's shutdown channel.
+	PerBackendTimeout time.Duration
+
+	// RequireQuorum, if greater than one, requires that at least this
+	// many backends return the *same* reply before
+	// Exchange returns it, rather than the default of racing all
+	// backends and returning the first reply. This defends against a
+	// single malicious meeting-place operator being able to unilaterally
+	// post a forged or replayed reply: its reply only counts toward its
+	// own tally, so it can't win a quorum unless enough other backends
+	// agree with it.
+	RequireQuorum int
+
+	mu        sync.Mutex
+	succeeded map[int][]byte
+	// succeededID is the id the replies in succeeded were posted to; nil
+	// after RestoreState, whose snapshot carries no id.
+	succeededID []byte
+}
+
+type meetingPlaceResult struct {
+	index int
+	reply []byte
+	err   error
+}
+
+// Padding returns Places[0].Padding(). All backends must agree on this
+// value; MultiMeetingPlace does not attempt to reconcile mismatched values.
+func (m *MultiMeetingPlace) Padding() int {
+	if len(m.Places) == 0 {
+		return 0
+	}
+	return m.Places[0].Padding()
+}
+
+// Reset forgets which backends have already produced a reply, so the next
+// Exchange call contacts every backend again. It's for starting a fresh
+// exchange with the same MultiMeetingPlace value, not for resuming one
+// across a restart - for that, see State and RestoreState.
+func (m *MultiMeetingPlace) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.succeeded = nil
+}
+
+// State returns a serialised snapshot of which backends have already
+// produced a reply, and what they replied with. Callers that
+// want KeyExchange.Run to resume after a restart without recontacting
+// backends it already heard back from should persist this alongside
+// KeyExchange.Marshal() and pass it to RestoreState on the MultiMeetingPlace
+// they rebuild before calling Run again.
+func (m *MultiMeetingPlace) State() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var buf []byte
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(m.succeeded)))
+	buf = append(buf, header[:4]...)
+	for i, reply := range m.succeeded {
+		binary.LittleEndian.PutUint32(header[:4], uint32(i))
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(reply)))
+		buf = append(buf, header[:]...)
+		buf = append(buf, reply...)
+	}
+	return buf
+}
+
+// RestoreState loads a snapshot produced by an earlier MultiMeetingPlace's
+// State, so that Exchange treats the backends it covers as already
+// succeeded instead of contacting them again. It must be called before the
+// first Exchange call on m.
+func (m *MultiMeetingPlace) RestoreState(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("panda: multi-meeting-place state is truncated")
+	}
+	n := binary.LittleEndian.Uint32(data[:4])
+	data = data[4:]
+
+	succeeded := make(map[int][]byte, n)
+	for ; n > 0; n-- {
+		if len(data) < 8 {
+			return errors.New("panda: multi-meeting-place state is truncated")
+		}
+		index := int(binary.LittleEndian.Uint32(data[:4]))
+		replyLen := binary.LittleEndian.Uint32(data[4:8])
+		data = data[8:]
+		if uint32(len(data)) < replyLen {
+			return errors.New("panda: multi-meeting-place state is truncated")
+		}
+		succeeded[index] = append([]byte{}, data[:replyLen]...)
+		data = data[replyLen:]
+	}
+	if len(data) != 0 {
+		return errors.New("panda: multi-meeting-place state has trailing garbage")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.succeeded = succeeded
+	m.succeededID = nil
+	return nil
+}
+
+// agreedReply reports whether some reply in tally has been seen at least
+// quorum times, returning that reply's bytes if so. It's the single place
+// that decides whether a quorum has actually been reached, so that a
+// backend's reply only ever counts toward winning by matching others -
+// never by merely being one of the first quorum replies to arrive.
+func agreedReply(tally map[string]int, quorum int) ([]byte, bool) {
+	for reply, count := range tally {
+		if count >= quorum {
+			return []byte(reply), true
+		}
+	}
+	return nil, false
+}
+
+// Exchange posts message to id at every backend in Places concurrently and
+// returns the reply that at least quorum backends agree on (quorum is 1
+// unless RequireQuorum is set, so the default remains racing all backends
+// and returning the first reply). Backends that already produced a reply
+// on an earlier call with the same id are reused instead of contacted
+// again; a call with a different id starts from no remembered replies.
+func (m *MultiMeetingPlace) Exchange(log func(string, ...interface{}), id, message []byte, shutdown chan struct{}) ([]byte, error) {
+	if len(m.Places) == 0 {
+		return nil, ErrNoMeetingPlaces
+	}
+
+	quorum := m.RequireQuorum
+	if quorum < 1 {
+		quorum = 1
+	}
+
+	m.mu.Lock()
+	if m.succeeded == nil || (m.succeededID != nil && !bytes.Equal(m.succeededID, id)) {
+		m.succeeded = make(map[int][]byte)
+	}
+	m.succeededID = append([]byte{}, id...)
+	pending := make([]int, 0, len(m.Places))
+	tally := make(map[string]int, len(m.Places))
+	for i := range m.Places {
+		if reply, ok := m.succeeded[i]; ok {
+			tally[string(reply)]++
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if reply, ok := agreedReply(tally, quorum); ok {
+		m.mu.Unlock()
+		return reply, nil
+	}
+	m.mu.Unlock()
+
+	results := make(chan meetingPlaceResult, len(pending))
+	for _, i := range pending {
+		go func(i int) {
+			backendShutdown := shutdown
+			if m.PerBackendTimeout > 0 {
+				timeout := make(chan struct{})
+				timer := time.AfterFunc(m.PerBackendTimeout, func() { close(timeout) })
+				defer timer.Stop()
+				backendShutdown = firstClosed(shutdown, timeout)
+			}
+
+			reply, err := m.Places[i].Exchange(log, id, message, backendShutdown)
+			results <- meetingPlaceResult{index: i, reply: reply, err: err}
+		}(i)
+	}
+
+	var firstErr error
+	for range pending {
+		res := <-results
+		if res.err != nil {
+			log("panda: multi-meeting-place backend %d failed: %s", res.index, res.err)
+			if firstErr == nil {
+				firstErr = res.err
+			}
+			continue
+		}
+
+		m.mu.Lock()
+		m.succeeded[res.index] = res.reply
+		tally[string(res.reply)]++
+		reply, ok := agreedReply(tally, quorum)
+		m.mu.Unlock()
+
+		if ok {
+			return reply, nil
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = ErrQuorumNotReached
+	}
+	return nil, firstErr
+}
+
+// firstClosed returns a channel that closes as soon as either a or b does.
+func firstClosed(a, b chan struct{}) chan struct{} {
+	out := make(chan struct{})
+	go func() {
+		select {
+		case <-a:
+		case <-b:
+		}
+		close(out)
+	}()
+	return out
+}
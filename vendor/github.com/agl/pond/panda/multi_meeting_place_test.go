@@ -0,0 +1,146 @@
+package panda
+
+import (
+	"errors"
+	"testing"
+)
+
+type fakeMeetingPlace struct {
+	padding int
+	reply   []byte
+	err     error
+}
+
+func (f *fakeMeetingPlace) Padding() int { return f.padding }
+
+func (f *fakeMeetingPlace) Exchange(log func(string, ...interface{}), id, message []byte, shutdown chan struct{}) ([]byte, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.reply, nil
+}
+
+func noopLog(string, ...interface{}) {}
+
+func TestMultiMeetingPlaceReturnsFirstReplyByDefault(t *testing.T) {
+	m := &MultiMeetingPlace{
+		Places: []MeetingPlace{
+			&fakeMeetingPlace{padding: 256, reply: []byte("a")},
+			&fakeMeetingPlace{padding: 256, err: errors.New("unreachable")},
+		},
+	}
+
+	reply, err := m.Exchange(noopLog, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Exchange: %s", err)
+	}
+	if string(reply) != "a" {
+		t.Fatalf("reply = %q, want %q", reply, "a")
+	}
+}
+
+func TestMultiMeetingPlaceQuorum(t *testing.T) {
+	downErr := errors.New("down")
+	m := &MultiMeetingPlace{
+		Places: []MeetingPlace{
+			&fakeMeetingPlace{padding: 256, reply: []byte("a")},
+			&fakeMeetingPlace{padding: 256, err: downErr},
+		},
+		RequireQuorum: 2,
+	}
+
+	// A backend failure is reported directly rather than masked as
+	// ErrQuorumNotReached, since it's more actionable for the caller.
+	if _, err := m.Exchange(noopLog, nil, nil, nil); err != downErr {
+		t.Fatalf("Exchange err = %v, want %v", err, downErr)
+	}
+
+	m2 := &MultiMeetingPlace{
+		Places: []MeetingPlace{
+			&fakeMeetingPlace{padding: 256, reply: []byte("a")},
+		},
+		RequireQuorum: 2,
+	}
+	if _, err := m2.Exchange(noopLog, nil, nil, nil); err != ErrQuorumNotReached {
+		t.Fatalf("Exchange err = %v, want ErrQuorumNotReached", err)
+	}
+}
+
+func TestMultiMeetingPlaceQuorumRejectsDisagreement(t *testing.T) {
+	m := &MultiMeetingPlace{
+		Places: []MeetingPlace{
+			&fakeMeetingPlace{padding: 256, reply: []byte("honest")},
+			&fakeMeetingPlace{padding: 256, reply: []byte("adversarial")},
+		},
+		RequireQuorum: 2,
+	}
+
+	// Neither reply was seen twice, so there's no agreed value even
+	// though two backends replied: a lone adversarial backend must not
+	// be able to win by being the one whose reply completes the count.
+	if _, err := m.Exchange(noopLog, nil, nil, nil); err != ErrQuorumNotReached {
+		t.Fatalf("Exchange err = %v, want ErrQuorumNotReached", err)
+	}
+
+	m2 := &MultiMeetingPlace{
+		Places: []MeetingPlace{
+			&fakeMeetingPlace{padding: 256, reply: []byte("honest")},
+			&fakeMeetingPlace{padding: 256, reply: []byte("honest")},
+			&fakeMeetingPlace{padding: 256, reply: []byte("adversarial")},
+		},
+		RequireQuorum: 2,
+	}
+	reply, err := m2.Exchange(noopLog, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Exchange: %s", err)
+	}
+	if string(reply) != "honest" {
+		t.Fatalf("reply = %q, want %q", reply, "honest")
+	}
+}
+
+func TestMultiMeetingPlaceNoBackends(t *testing.T) {
+	m := &MultiMeetingPlace{}
+	if _, err := m.Exchange(noopLog, nil, nil, nil); err != ErrNoMeetingPlaces {
+		t.Fatalf("Exchange err = %v, want ErrNoMeetingPlaces", err)
+	}
+}
+
+func TestMultiMeetingPlaceStateRoundTrip(t *testing.T) {
+	m := &MultiMeetingPlace{
+		Places: []MeetingPlace{
+			&fakeMeetingPlace{padding: 256, reply: []byte("a")},
+			&fakeMeetingPlace{padding: 256, err: errors.New("unreachable")},
+		},
+	}
+	if _, err := m.Exchange(noopLog, nil, nil, nil); err != nil {
+		t.Fatalf("Exchange: %s", err)
+	}
+
+	state := m.State()
+
+	// A freshly constructed MultiMeetingPlace starts with nothing
+	// remembered, so a naive retry would recontact backend 0 too.
+	resumed := &MultiMeetingPlace{Places: m.Places}
+	if err := resumed.RestoreState(state); err != nil {
+		t.Fatalf("RestoreState: %s", err)
+	}
+
+	// Backend 0 now only fails if contacted again; since RestoreState
+	// should have remembered its reply, Exchange must not touch it.
+	resumed.Places[0] = &fakeMeetingPlace{padding: 256, err: errors.New("should not be contacted again")}
+	reply, err := resumed.Exchange(noopLog, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Exchange after restore: %s", err)
+	}
+	if string(reply) != "a" {
+		t.Fatalf("reply = %q, want %q", reply, "a")
+	}
+}
+
+func TestMultiMeetingPlaceRestoreStateRejectsTruncated(t *testing.T) {
+	m := &MultiMeetingPlace{}
+	if err := m.RestoreState([]byte{1, 2, 3}); err == nil {
+		t.Fatalf("RestoreState accepted truncated data")
+	}
+}
@@ -7,10 +7,6 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
-	"os"
-	"os/exec"
-	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 
@@ -19,7 +15,6 @@ import (
 	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/nacl/secretbox"
-	"golang.org/x/crypto/scrypt"
 
 	panda_proto "github.com/agl/pond/panda/proto"
 )
@@ -33,6 +28,12 @@ const (
 	// (silently, painfully) break clients that are too old to support
 	// them.
 	generatedSecretStringPrefix2 = "r["
+	// generatedSecretStringPrefix3 marks a secret produced by
+	// NewDicewareSecret: a space-separated sequence of words from
+	// dicewareWordlist followed by a trailing check word, rather than a
+	// run of hex digits. Like generatedSecretStringPrefix2, these are
+	// sufficiently random that scrypt is skipped in derivePassword.
+	generatedSecretStringPrefix3 = "rw:"
 )
 
 // NewSecretString generates a random, human readable string with a special
@@ -55,8 +56,12 @@ func NewSecretString(rand io.Reader) string {
 }
 
 // isValidSecretString returns true if s is of the form generated by
-// NewSecretString.
+// NewSecretString or NewDicewareSecret.
 func isValidSecretString(s string) bool {
+	if strings.HasPrefix(s, generatedSecretStringPrefix3) {
+		return isValidDicewareSecretString(s)
+	}
+
 	if !strings.HasPrefix(s, generatedSecretStringPrefix) &&
 		!strings.HasPrefix(s, generatedSecretStringPrefix2) {
 		return false
@@ -78,18 +83,110 @@ func isValidSecretString(s string) bool {
 	return b[16] == digest[0] && b[17] == digest[1]
 }
 
+// isValidDicewareSecretString returns true if s is of the form generated by
+// NewDicewareSecret: generatedSecretStringPrefix3 followed by one or more
+// words from dicewareWordlist and a trailing check word.
+func isValidDicewareSecretString(s string) bool {
+	words := strings.Fields(s[len(generatedSecretStringPrefix3):])
+	if len(words) < 2 {
+		return false
+	}
+
+	indexes := make([]int, len(words)-1)
+	for i, w := range words[:len(words)-1] {
+		idx, ok := dicewareWordIndex[w]
+		if !ok {
+			return false
+		}
+		indexes[i] = idx
+	}
+
+	checkIdx, ok := dicewareWordIndex[words[len(words)-1]]
+	if !ok {
+		return false
+	}
+
+	return checkIdx == dicewareCheckWordIndex(indexes)
+}
+
+// dicewareCheckWordIndex derives the index of the trailing check word for a
+// diceware secret from the indexes of its other words: a two-byte SHA-256
+// prefix over the concatenated (little-endian) indexes, reduced mod the
+// wordlist size. This mirrors the checksum-byte idea in NewSecretString,
+// adapted to reject a typo in any word rather than any hex digit.
+func dicewareCheckWordIndex(indexes []int) int {
+	var buf bytes.Buffer
+	for _, idx := range indexes {
+		binary.Write(&buf, binary.LittleEndian, uint16(idx))
+	}
+	digest := sha256.Sum256(buf.Bytes())
+	return int(binary.LittleEndian.Uint16(digest[:2])) % len(dicewareWordlist)
+}
+
 // IsAcceptableSecretString returns true if s should be accepted as a secret
 // string. The only strings that will be rejected are those that start with
 // generatedSecretStringPrefix but don't have a matching checksum.
 func IsAcceptableSecretString(s string) bool {
 	if !strings.HasPrefix(s, generatedSecretStringPrefix) &&
-		!strings.HasPrefix(s, generatedSecretStringPrefix2) {
+		!strings.HasPrefix(s, generatedSecretStringPrefix2) &&
+		!strings.HasPrefix(s, generatedSecretStringPrefix3) {
 		return true
 	}
 
 	return isValidSecretString(s)
 }
 
+// minDicewareWordCount is the fewest words NewDicewareSecret will generate:
+// 8 words of dicewareWordlist give log2(7776)*8 =~ 103 bits of entropy,
+// fewer than the 128 random bits behind a NewSecretString secret.
+// isStrongRandom treats a generatedSecretStringPrefix3 secret with at least
+// this many words (not counting the check word) as strong enough to skip
+// derivePassword's scrypt/Argon2 step.
+const minDicewareWordCount = 8
+
+// NewDicewareSecret generates a random secret string as a sequence of
+// wordCount words drawn from dicewareWordlist (EFF's long wordlist, 7776
+// entries, ~12.9 bits of entropy each), with a trailing check word appended
+// so that a typo in any word is rejected. This is far easier to read aloud
+// or relay over SMS than the hex form produced by NewSecretString.
+func NewDicewareSecret(rand io.Reader, wordCount int) string {
+	if wordCount < minDicewareWordCount {
+		panic("panda: wordCount must be at least minDicewareWordCount")
+	}
+
+	indexes := make([]int, wordCount)
+	for i := range indexes {
+		indexes[i] = dicewareRandIndex(rand)
+	}
+
+	words := make([]string, wordCount+1)
+	for i, idx := range indexes {
+		words[i] = dicewareWordlist[idx]
+	}
+	words[wordCount] = dicewareWordlist[dicewareCheckWordIndex(indexes)]
+
+	return generatedSecretStringPrefix3 + strings.Join(words, " ")
+}
+
+// dicewareRandIndex returns a uniformly distributed index into
+// dicewareWordlist, read from rand via rejection sampling to avoid modulo
+// bias.
+func dicewareRandIndex(rand io.Reader) int {
+	n := uint32(len(dicewareWordlist))
+	limit := (uint32(1) << 16) - (uint32(1)<<16)%n
+
+	var buf [2]byte
+	for {
+		if _, err := io.ReadFull(rand, buf[:]); err != nil {
+			panic("error reading from rand: " + err.Error())
+		}
+		v := uint32(binary.LittleEndian.Uint16(buf[:]))
+		if v < limit {
+			return int(v % n)
+		}
+	}
+}
+
 var ShutdownErr = errors.New("panda: shutdown requested")
 
 type SharedSecret struct {
@@ -97,10 +194,28 @@ type SharedSecret struct {
 	Cards            CardStack
 	Day, Month, Year int
 	Hours, Minutes   int
+
+	// KDFParams, if set, selects the KDF that derivePassword uses to turn
+	// this secret into key material, and is serialised alongside the rest
+	// of the shared secret so that both peers derive the same key
+	// material from it regardless of which one created the KeyExchange.
+	// A nil value keeps the default of ScryptKDF{}.
+	KDFParams *Argon2idKDF
 }
 
 func (s *SharedSecret) isStrongRandom() bool {
-	return strings.HasPrefix(s.Secret, generatedSecretStringPrefix2) && isValidSecretString(s.Secret)
+	if strings.HasPrefix(s.Secret, generatedSecretStringPrefix2) {
+		return isValidSecretString(s.Secret)
+	}
+	if strings.HasPrefix(s.Secret, generatedSecretStringPrefix3) {
+		// Don't just trust the prefix: a secret with fewer than
+		// minDicewareWordCount words (words below also holds the check
+		// word, hence the strict comparison) goes through
+		// derivePassword's scrypt/Argon2 path.
+		words := strings.Fields(s.Secret[len(generatedSecretStringPrefix3):])
+		return len(words) > minDicewareWordCount && isValidSecretString(s.Secret)
+	}
+	return false
 }
 
 func (s *SharedSecret) toProto() *panda_proto.KeyExchange_SharedSecret {
@@ -122,6 +237,12 @@ func (s *SharedSecret) toProto() *panda_proto.KeyExchange_SharedSecret {
 			Minutes: proto.Int32(int32(s.Minutes)),
 		}
 	}
+	if s.KDFParams != nil {
+		ret.Kdf = panda_proto.KeyExchange_SharedSecret_ARGON2ID.Enum()
+		ret.ArgonTime = proto.Uint32(s.KDFParams.Time)
+		ret.ArgonMemory = proto.Uint32(s.KDFParams.Memory)
+		ret.ArgonThreads = proto.Uint32(uint32(s.KDFParams.Threads))
+	}
 
 	return ret
 }
@@ -146,6 +267,13 @@ func newSharedSecret(p *panda_proto.KeyExchange_SharedSecret) (*SharedSecret, bo
 			return nil, false
 		}
 	}
+	if p.GetKdf() == panda_proto.KeyExchange_SharedSecret_ARGON2ID {
+		ret.KDFParams = &Argon2idKDF{
+			Time:    p.GetArgonTime(),
+			Memory:  p.GetArgonMemory(),
+			Threads: uint8(p.GetArgonThreads()),
+		}
+	}
 
 	return ret, true
 }
@@ -162,6 +290,15 @@ type KeyExchange struct {
 	Testing      bool
 	ShutdownChan chan struct{}
 
+	// KDF is used by derivePassword to turn the shared secret into key
+	// material when it isn't already sufficiently random (see
+	// SharedSecret.isStrongRandom). It defaults to ScryptKDF{}, the
+	// original behaviour, for compatibility with older clients; it's
+	// overridden by SharedSecret.KDFParams when that's set, so that both
+	// peers in an exchange agree on the KDF regardless of which one set
+	// this field.
+	KDF KDF
+
 	rand         io.Reader
 	status       panda_proto.KeyExchange_Status
 	meetingPlace MeetingPlace
@@ -173,15 +310,39 @@ type KeyExchange struct {
 	dhPublic, dhPrivate     [32]byte
 	sharedKey               [32]byte
 	message1, message2      []byte
+
+	// streamChunkSize and streamChunks split kx.kxBytes into
+	// meeting-place-sized chunks when it's too large for a single
+	// EXCHANGE2 message; they're derived lazily from kxBytes and the
+	// meeting place's padding (see ensureStreamChunks) rather than
+	// serialised directly.
+	streamChunkSize   int
+	streamTotalChunks int
+	streamChunks      [][]byte
+
+	// streamRecvIdx, streamPeerTotalLen, streamPeerChunks and
+	// streamRecvBuf track the streamed reply we're reassembling from the
+	// peer, and are persisted (every streamPersistInterval chunks, see
+	// exchangeStream) so EXCHANGE_STREAM can resume after a restart
+	// without re-requesting more than that many already-received chunks.
+	streamRecvIdx      int
+	streamPeerTotalLen uint32
+	streamPeerChunks   int
+	streamRecvBuf      []byte
 }
 
 func NewKeyExchange(rand io.Reader, meetingPlace MeetingPlace, sharedSecret *SharedSecret, kxBytes []byte) (*KeyExchange, error) {
-	if 24 /* nonce */ +4 /* length */ +len(kxBytes)+secretbox.Overhead > meetingPlace.Padding() {
-		return nil, errors.New("panda: key exchange too large for meeting place")
+	// 1 (kind byte) + 4 (total length) + 4 (total chunk count), the
+	// largest of the two EXCHANGE2 payload shapes (see exchange1). Any
+	// kxBytes too big to fit inline is sent in EXCHANGE_STREAM chunks
+	// instead, so there's no upper bound on len(kxBytes) here.
+	if 24 /* nonce */ +1+4+4+secretbox.Overhead > meetingPlace.Padding() {
+		return nil, errors.New("panda: meeting place padding too small for a key exchange")
 	}
 
 	kx := &KeyExchange{
 		Log:          func(format string, args ...interface{}) {},
+		KDF:          ScryptKDF{},
 		rand:         rand,
 		meetingPlace: meetingPlace,
 		status:       panda_proto.KeyExchange_INIT,
@@ -210,6 +371,7 @@ func UnmarshalKeyExchange(rand io.Reader, meetingPlace MeetingPlace, serialised
 	}
 
 	kx := &KeyExchange{
+		KDF:          ScryptKDF{},
 		rand:         rand,
 		meetingPlace: meetingPlace,
 		status:       p.GetStatus(),
@@ -227,6 +389,13 @@ func UnmarshalKeyExchange(rand io.Reader, meetingPlace MeetingPlace, serialised
 	copy(kx.dhPrivate[:], p.DhPrivate)
 	curve25519.ScalarBaseMult(&kx.dhPublic, &kx.dhPrivate)
 
+	if kx.status == panda_proto.KeyExchange_EXCHANGE_STREAM {
+		kx.streamRecvIdx = int(p.GetStreamRecvIndex())
+		kx.streamPeerTotalLen = p.GetStreamPeerTotalLen()
+		kx.streamPeerChunks = int(p.GetStreamPeerChunks())
+		kx.streamRecvBuf = append([]byte{}, p.StreamRecvBuf...)
+	}
+
 	return kx, nil
 }
 
@@ -252,6 +421,12 @@ func (kx *KeyExchange) updateSerialised() {
 		p.Message2 = kx.message2
 		p.SharedKey = kx.sharedKey[:]
 	}
+	if kx.status == panda_proto.KeyExchange_EXCHANGE_STREAM {
+		p.StreamRecvIndex = proto.Uint32(uint32(kx.streamRecvIdx))
+		p.StreamPeerTotalLen = proto.Uint32(kx.streamPeerTotalLen)
+		p.StreamPeerChunks = proto.Uint32(uint32(kx.streamPeerChunks))
+		p.StreamRecvBuf = kx.streamRecvBuf
+	}
 	serialised, err := proto.Marshal(p)
 	if err != nil {
 		panic(err)
@@ -304,6 +479,12 @@ func (kx *KeyExchange) Run() ([]byte, error) {
 			return nil, err
 		}
 		return reply, nil
+	case panda_proto.KeyExchange_EXCHANGE_STREAM:
+		reply, err := kx.exchangeStream()
+		if err != nil {
+			return nil, err
+		}
+		return reply, nil
 	default:
 		panic("unknown state")
 	}
@@ -329,30 +510,11 @@ func (kx *KeyExchange) derivePassword() error {
 			return err
 		}
 	} else {
-		var data []byte
-		if runtime.GOARCH == "386" && runtime.GOOS == "linux" {
-			// We're having GC problems on 32-bit systems with the
-			// scrypt allocation. In order to help the GC out, the
-			// scrypt computation is done in a subprocess.
-			cmd := exec.Command("/proc/self/exe", "--panda-scrypt")
-			var in, out bytes.Buffer
-			binary.Write(&in, binary.LittleEndian, uint32(len(serialised)))
-			in.Write(serialised)
-
-			cmd.Stdin = &in
-			cmd.Stdout = &out
-			cmd.Stderr = os.Stderr
-			if err := cmd.Run(); err != nil {
-				return err
-			}
-			data = out.Bytes()
-			if len(data) != 32*3 {
-				return errors.New("scrypt subprocess returned wrong number of bytes: " + strconv.Itoa(len(data)))
-			}
-		} else {
-			if data, err = scrypt.Key(serialised, nil, 1<<17, 16, 4, 32*3); err != nil {
-				return err
-			}
+		kdf := kx.sharedSecretKDF()
+
+		data := make([]byte, 32*3)
+		if err := kdf.Derive(serialised, data); err != nil {
+			return err
 		}
 
 		copy(kx.key[:], data)
@@ -379,6 +541,20 @@ func (kx *KeyExchange) derivePassword() error {
 	return nil
 }
 
+// sharedSecretKDF returns the KDF to use for derivePassword: the shared
+// secret's own KDFParams if it carries one (so that both peers agree on it
+// regardless of which one configured kx.KDF), falling back to kx.KDF, and
+// finally to ScryptKDF{} for a zero-value KeyExchange.
+func (kx *KeyExchange) sharedSecretKDF() KDF {
+	if kx.sharedSecret.KDFParams != nil {
+		return *kx.sharedSecret.KDFParams
+	}
+	if kx.KDF != nil {
+		return kx.KDF
+	}
+	return ScryptKDF{}
+}
+
 func (kx *KeyExchange) exchange1() error {
 	reply, err := kx.meetingPlace.Exchange(kx.Log, kx.meeting1[:], kx.message1[:], kx.ShutdownChan)
 	if err != nil {
@@ -397,10 +573,26 @@ func (kx *KeyExchange) exchange1() error {
 
 	paddedLen := kx.meetingPlace.Padding()
 	padded := make([]byte, paddedLen-24 /* nonce */ -secretbox.Overhead)
-	binary.LittleEndian.PutUint32(padded, uint32(len(kx.kxBytes)))
-	copy(padded[4:], kx.kxBytes)
-	if _, err := io.ReadFull(kx.rand, padded[4+len(kx.kxBytes):]); err != nil {
-		return err
+
+	if !kx.kxBytesNeedsStream() {
+		// kxBytes fits inline: [kind=streamKindInline][length][kxBytes][padding].
+		padded[0] = streamKindInline
+		binary.LittleEndian.PutUint32(padded[1:], uint32(len(kx.kxBytes)))
+		copy(padded[5:], kx.kxBytes)
+		if _, err := io.ReadFull(kx.rand, padded[5+len(kx.kxBytes):]); err != nil {
+			return err
+		}
+	} else {
+		// kxBytes is too big for one message: send a header describing
+		// it instead, and stream the actual bytes over
+		// EXCHANGE_STREAM.
+		kx.ensureStreamChunks()
+		padded[0] = streamKindHeader
+		binary.LittleEndian.PutUint32(padded[1:5], uint32(len(kx.kxBytes)))
+		binary.LittleEndian.PutUint32(padded[5:9], uint32(kx.streamTotalChunks))
+		if _, err := io.ReadFull(kx.rand, padded[9:]); err != nil {
+			return err
+		}
 	}
 
 	var nonce [24]byte
@@ -435,14 +627,56 @@ func (kx *KeyExchange) exchange2() ([]byte, error) {
 		return nil, errors.New("panda: peer's message cannot be authenticated")
 	}
 
-	if len(message) < 4 {
+	if len(message) < 1 {
 		return nil, errors.New("panda: peer's message is invalid")
 	}
-	l := binary.LittleEndian.Uint32(message)
-	message = message[4:]
-	if l > uint32(len(message)) {
-		return nil, errors.New("panda: peer's message is truncated")
+
+	switch message[0] {
+	case streamKindInline:
+		message = message[1:]
+		if len(message) < 4 {
+			return nil, errors.New("panda: peer's message is invalid")
+		}
+		l := binary.LittleEndian.Uint32(message)
+		message = message[4:]
+		if l > uint32(len(message)) {
+			return nil, errors.New("panda: peer's message is truncated")
+		}
+		payload := message[:int(l)]
+
+		if !kx.kxBytesNeedsStream() {
+			return payload, nil
+		}
+
+		// Our own kxBytes didn't fit inline even though the peer's did:
+		// we still have to stream our chunks over EXCHANGE_STREAM, with
+		// the peer's already-complete reply as the "peer total" side of
+		// that exchange, rather than returning here and leaving the
+		// peer waiting at chunkMeetingPoint(0) forever.
+		kx.streamPeerTotalLen = uint32(len(payload))
+		kx.streamPeerChunks = 0
+		kx.streamRecvBuf = append([]byte{}, payload...)
+		kx.status = panda_proto.KeyExchange_EXCHANGE_STREAM
+		kx.updateSerialised()
+		return kx.exchangeStream()
+
+	case streamKindHeader:
+		if len(message) < 9 {
+			return nil, errors.New("panda: peer's message is invalid")
+		}
+		totalLen := binary.LittleEndian.Uint32(message[1:5])
+		chunks := int(binary.LittleEndian.Uint32(message[5:9]))
+		if !validStreamHeader(totalLen, chunks, kx.meetingPlace.Padding()-24-secretbox.Overhead) {
+			return nil, errors.New("panda: peer's stream header is invalid")
+		}
+		kx.streamPeerTotalLen = totalLen
+		kx.streamPeerChunks = chunks
+		kx.streamRecvBuf = make([]byte, 0, totalLen)
+		kx.status = panda_proto.KeyExchange_EXCHANGE_STREAM
+		kx.updateSerialised()
+		return kx.exchangeStream()
+
+	default:
+		return nil, errors.New("panda: peer's message has an unrecognised kind")
 	}
-	message = message[:int(l)]
-	return message, nil
 }
\ No newline at end of file
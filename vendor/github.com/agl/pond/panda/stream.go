@@ -0,0 +1,203 @@
+package panda
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// streamKindInline and streamKindHeader are the two shapes an EXCHANGE2
+// message can take, identified by its first byte: a small kxBytes is sent
+// inline ([kind][length][bytes][padding]); one too large for a single
+// message instead gets a header ([kind][total length][total chunk count])
+// and is streamed over EXCHANGE_STREAM.
+const (
+	streamKindInline = 0
+	streamKindHeader = 1
+)
+
+// streamPersistInterval is how many chunks exchangeStream processes between
+// calls to updateSerialised; see the comment at its call site.
+const streamPersistInterval = 16
+
+// kxBytesNeedsStream reports whether kx.kxBytes is too large to fit inline
+// in a single EXCHANGE2 message for this meeting place, matching the
+// inline-vs-header decision exchange1 makes when building message2. It must
+// agree with that decision, since exchange2 also uses it - on the side
+// whose own kxBytes needs a header - to decide whether to enter
+// EXCHANGE_STREAM even when the peer's reply arrived inline.
+func (kx *KeyExchange) kxBytesNeedsStream() bool {
+	padded := kx.meetingPlace.Padding() - 24 /* nonce */ - secretbox.Overhead
+	return 1+4+len(kx.kxBytes) > padded
+}
+
+// ensureStreamChunks splits kx.kxBytes into fixed-size chunks sized to fit
+// one meeting-place slot, if it hasn't already done so. It's idempotent and
+// safe to call again after UnmarshalKeyExchange, since it only depends on
+// kxBytes and the meeting place's padding - both of which are always
+// available - rather than on anything that needs to be persisted.
+func (kx *KeyExchange) ensureStreamChunks() {
+	if kx.streamChunkSize != 0 {
+		return
+	}
+
+	kx.streamChunkSize = kx.meetingPlace.Padding() - 24 /* nonce */ - secretbox.Overhead
+	for off := 0; off < len(kx.kxBytes); off += kx.streamChunkSize {
+		end := off + kx.streamChunkSize
+		if end > len(kx.kxBytes) {
+			end = len(kx.kxBytes)
+		}
+		kx.streamChunks = append(kx.streamChunks, kx.kxBytes[off:end])
+	}
+	kx.streamTotalChunks = len(kx.streamChunks)
+}
+
+// chunkMeetingPoint returns the meeting point at which chunk i of the
+// stream is exchanged: HKDF(sharedKey, "panda-chunk", i), distinct from
+// meeting1/meeting2 and from every other chunk's meeting point.
+func (kx *KeyExchange) chunkMeetingPoint(i int) [32]byte {
+	info := make([]byte, len("panda-chunk")+4)
+	copy(info, "panda-chunk")
+	binary.LittleEndian.PutUint32(info[len("panda-chunk"):], uint32(i))
+
+	h := hkdf.New(sha256.New, kx.sharedKey[:], nil, info)
+	var meeting [32]byte
+	io.ReadFull(h, meeting[:])
+	return meeting
+}
+
+// chunkRealLen returns how many bytes of chunk i are real payload rather
+// than padding, given that side has total chunks summing to totalLen bytes
+// in chunkSize-sized pieces (the last one short). It's 0 once i is past
+// that side's total, which lets the two peers stream different numbers of
+// chunks without either one misreading the other's padding as data.
+// Callers must only pass (total, totalLen) pairs that have already been
+// checked by validStreamHeader, or the "last chunk" arithmetic can go
+// negative.
+func chunkRealLen(i, total int, totalLen uint32, chunkSize int) int {
+	switch {
+	case i >= total:
+		return 0
+	case i == total-1:
+		return int(totalLen) - i*chunkSize
+	default:
+		return chunkSize
+	}
+}
+
+// maxStreamTotalLen bounds the total length a peer's EXCHANGE2 header may
+// claim, so that a malicious or corrupted header can't force us to
+// preallocate an unreasonable amount of memory for streamRecvBuf.
+const maxStreamTotalLen = 1 << 30 // 1 GiB
+
+// validStreamHeader reports whether totalLen and chunks are a consistent,
+// boundeded EXCHANGE2 stream header for the given chunkSize: chunks must
+// account for exactly totalLen bytes, with every chunk but the last full.
+func validStreamHeader(totalLen uint32, chunks int, chunkSize int) bool {
+	if chunks < 0 || totalLen > maxStreamTotalLen {
+		return false
+	}
+	if chunks == 0 {
+		return totalLen == 0
+	}
+	if totalLen == 0 {
+		return false
+	}
+	lastChunkLen := int(totalLen) - (chunks-1)*chunkSize
+	return lastChunkLen > 0 && lastChunkLen <= chunkSize
+}
+
+// exchangeStream drives the chunked tail of a key exchange whose kxBytes
+// didn't fit in a single EXCHANGE2 message. It swaps chunk i of our
+// kxBytes for chunk i of the peer's at chunkMeetingPoint(i), for every i up
+// to the larger of the two total chunk counts, persisting streamRecvIdx
+// every streamPersistInterval rounds and after the last one, so a restart
+// re-fetches fewer than streamPersistInterval chunks it had already received.
+func (kx *KeyExchange) exchangeStream() ([]byte, error) {
+	kx.ensureStreamChunks()
+
+	total := kx.streamTotalChunks
+	if kx.streamPeerChunks > total {
+		total = kx.streamPeerChunks
+	}
+
+	for i := kx.streamRecvIdx; i < total; i++ {
+		ourLen := chunkRealLen(i, kx.streamTotalChunks, uint32(len(kx.kxBytes)), kx.streamChunkSize)
+
+		padded := make([]byte, kx.streamChunkSize)
+		if ourLen > 0 {
+			copy(padded, kx.streamChunks[i])
+		}
+		if _, err := io.ReadFull(kx.rand, padded[ourLen:]); err != nil {
+			return nil, err
+		}
+
+		var nonce [24]byte
+		if _, err := io.ReadFull(kx.rand, nonce[:]); err != nil {
+			return nil, err
+		}
+
+		sealed := make([]byte, 24+len(padded)+secretbox.Overhead)
+		copy(sealed, nonce[:])
+		secretbox.Seal(sealed[24:24], padded, &nonce, &kx.sharedKey)
+
+		meeting := kx.chunkMeetingPoint(i)
+		reply, err := kx.meetingPlace.Exchange(kx.Log, meeting[:], sealed, kx.ShutdownChan)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(reply) < 24 {
+			return nil, errors.New("panda: meeting point reply too small")
+		}
+		var replyNonce [24]byte
+		copy(replyNonce[:], reply[:24])
+		chunk, ok := secretbox.Open(nil, reply[24:], &replyNonce, &kx.sharedKey)
+		if !ok {
+			return nil, errors.New("panda: peer's chunk cannot be authenticated")
+		}
+
+		peerLen := chunkRealLen(i, kx.streamPeerChunks, kx.streamPeerTotalLen, kx.streamChunkSize)
+		if peerLen > len(chunk) {
+			return nil, errors.New("panda: peer's chunk is truncated")
+		}
+		kx.streamRecvBuf = append(kx.streamRecvBuf, chunk[:peerLen]...)
+
+		kx.streamRecvIdx = i + 1
+		// Persisting after every chunk would re-marshal the whole
+		// (monotonically growing) streamRecvBuf each round, making a
+		// long stream O(total^2). Persist every streamPersistInterval
+		// chunks instead, and always on the last one, so a resumed
+		// exchange re-fetches at most that many chunks.
+		if (i+1)%streamPersistInterval == 0 || i == total-1 {
+			kx.updateSerialised()
+		}
+		kx.Log("stream chunk %d/%d complete", i+1, total)
+		if kx.shouldStop() {
+			return nil, ShutdownErr
+		}
+	}
+
+	if uint32(len(kx.streamRecvBuf)) != kx.streamPeerTotalLen {
+		return nil, errors.New("panda: streamed message has the wrong total length")
+	}
+	return kx.streamRecvBuf, nil
+}
+
+// Progress reports how many chunks of the peer's streamed kxBytes have been
+// received and authenticated so far, and how many there are in total. It
+// returns (0, 0) before the peer's EXCHANGE2 header has arrived, and
+// (n, n) once all of the peer's chunks have been received - even while we
+// may still be sending some of our own, if our kxBytes needed more chunks
+// than theirs did.
+func (kx *KeyExchange) Progress() (done, total int) {
+	done = kx.streamRecvIdx
+	if done > kx.streamPeerChunks {
+		done = kx.streamPeerChunks
+	}
+	return done, kx.streamPeerChunks
+}
@@ -0,0 +1,118 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	panda_proto "github.com/agl/pond/panda/proto"
+)
+
+func TestStreamStateSurvivesMarshalRoundTrip(t *testing.T) {
+	meetingPlace := &fakeMeetingPlace{padding: 256}
+	secret := &SharedSecret{Secret: "hello"}
+
+	kx, err := NewKeyExchange(rand.Reader, meetingPlace, secret, []byte("kx bytes"))
+	if err != nil {
+		t.Fatalf("NewKeyExchange: %s", err)
+	}
+
+	kx.status = panda_proto.KeyExchange_EXCHANGE_STREAM
+	kx.streamRecvIdx = 3
+	kx.streamPeerTotalLen = 4096
+	kx.streamPeerChunks = 7
+	kx.streamRecvBuf = []byte("partially reassembled reply")
+	kx.updateSerialised()
+
+	round, err := UnmarshalKeyExchange(rand.Reader, meetingPlace, kx.Marshal())
+	if err != nil {
+		t.Fatalf("UnmarshalKeyExchange: %s", err)
+	}
+
+	if round.status != panda_proto.KeyExchange_EXCHANGE_STREAM {
+		t.Fatalf("status = %v, want EXCHANGE_STREAM", round.status)
+	}
+	if round.streamRecvIdx != kx.streamRecvIdx {
+		t.Fatalf("streamRecvIdx = %d, want %d", round.streamRecvIdx, kx.streamRecvIdx)
+	}
+	if round.streamPeerTotalLen != kx.streamPeerTotalLen {
+		t.Fatalf("streamPeerTotalLen = %d, want %d", round.streamPeerTotalLen, kx.streamPeerTotalLen)
+	}
+	if round.streamPeerChunks != kx.streamPeerChunks {
+		t.Fatalf("streamPeerChunks = %d, want %d", round.streamPeerChunks, kx.streamPeerChunks)
+	}
+	if string(round.streamRecvBuf) != string(kx.streamRecvBuf) {
+		t.Fatalf("streamRecvBuf = %q, want %q", round.streamRecvBuf, kx.streamRecvBuf)
+	}
+}
+
+// TestAsymmetricStreamSizesDoNotDeadlock covers the case where only one
+// side's kxBytes needs EXCHANGE_STREAM chunking: exchange2 used to decide
+// whether to stream based solely on the kind of message it received, so
+// the side whose own kxBytes needed a header but whose peer's reply was
+// inline would return early instead of posting its chunks, leaving the
+// peer blocked in exchangeStream forever.
+func TestAsymmetricStreamSizesDoNotDeadlock(t *testing.T) {
+	meetingPlace := newRendezvousMeetingPlace(256)
+	secret := &SharedSecret{Secret: "shared secret for asymmetric stream test"}
+
+	bigPayload := make([]byte, 5000)
+	if _, err := rand.Read(bigPayload); err != nil {
+		t.Fatal(err)
+	}
+	smallPayload := []byte("small reply")
+
+	big, err := NewKeyExchange(rand.Reader, meetingPlace, secret, bigPayload)
+	if err != nil {
+		t.Fatalf("NewKeyExchange(big): %s", err)
+	}
+	big.Testing = true
+
+	small, err := NewKeyExchange(rand.Reader, meetingPlace, secret, smallPayload)
+	if err != nil {
+		t.Fatalf("NewKeyExchange(small): %s", err)
+	}
+	small.Testing = true
+
+	type result struct {
+		reply []byte
+		err   error
+	}
+	bigResult := make(chan result, 1)
+	smallResult := make(chan result, 1)
+
+	go func() {
+		reply, err := big.Run()
+		bigResult <- result{reply, err}
+	}()
+	go func() {
+		reply, err := small.Run()
+		smallResult <- result{reply, err}
+	}()
+
+	timeout := time.After(10 * time.Second)
+	var gotBig, gotSmall bool
+	for !gotBig || !gotSmall {
+		select {
+		case r := <-bigResult:
+			if r.err != nil {
+				t.Fatalf("big.Run(): %s", r.err)
+			}
+			if !bytes.Equal(r.reply, smallPayload) {
+				t.Fatalf("big.Run() = %x, want the small side's kxBytes", r.reply)
+			}
+			gotBig = true
+		case r := <-smallResult:
+			if r.err != nil {
+				t.Fatalf("small.Run(): %s", r.err)
+			}
+			if !bytes.Equal(r.reply, bigPayload) {
+				t.Fatalf("small.Run() returned the wrong payload, want the big side's kxBytes")
+			}
+			gotSmall = true
+		case <-timeout:
+			t.Fatal("timed out: asymmetric stream exchange deadlocked")
+		}
+	}
+}
@@ -0,0 +1,402 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// PreKey and SignedPreKey mirror the wire format served by the prekey
+// server's registerKeys/recipientKeys endpoints (base64-encoded Curve25519
+// public keys), so that a PreKeyBundle fetched by X3DHExchange decodes
+// straight off the HTTP response body.
+type PreKey struct {
+	KeyID     int64  `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+}
+
+type SignedPreKey struct {
+	KeyID     int64  `json:"keyId"`
+	PublicKey string `json:"publicKey"`
+	Signature string `json:"signature"`
+}
+
+// PreKeyBundle is a peer's set of X3DH prekeys, as published to the prekey
+// server. IdentityKey is base64-encoded Ed25519 (see keys.go's
+// verifySignedPreKey), not the Curve25519 key used for X3DH's DH terms.
+type PreKeyBundle struct {
+	SignedPreKey  SignedPreKey `json:"signedKey"`
+	IdentityKey   string       `json:"identityKey"`
+	LastResortKey PreKey       `json:"lastResortKey"`
+	Keys          []PreKey     `json:"keys"`
+}
+
+// SessionKeys is the result of a successful X3DHExchange.Run: a root key
+// ready to seed a Double Ratchet, and the peer's authenticated Ed25519
+// signing identity key.
+type SessionKeys struct {
+	RootKey      [32]byte
+	PeerIdentity [32]byte
+}
+
+// X3DHIdentity is a party's long-term X3DH key material.
+//
+// DHPublic/DHPrivate and SigningPublic/SigningPrivate are deliberately two
+// distinct keypairs rather than the same 32 bytes reinterpreted: Curve25519
+// (Montgomery curve) and Ed25519 (twisted Edwards curve) use different point
+// encodings, so a scalar generated for one isn't a valid point, let alone a
+// valid key, for the other.
+type X3DHIdentity struct {
+	// DHPublic/DHPrivate are this party's long-term Curve25519 identity
+	// keypair.
+	DHPublic, DHPrivate [32]byte
+
+	// SignedPreKeyPublic/SignedPreKeyPrivate are the rotating Curve25519
+	// prekey this party has already published in its own PreKeyBundle
+	// (signed with SigningPrivate - see keys.go's verifySignedPreKey).
+	// X3DHExchange needs the private half whenever this party is the
+	// responder for a given exchange (see Run), since the initiator's DH1
+	// and DH3 terms are computed against it.
+	SignedPreKeyPublic, SignedPreKeyPrivate [32]byte
+
+	// SigningPublic/SigningPrivate are this party's long-term Ed25519
+	// signing identity keypair: the keypair used to sign SignedPreKeyPublic
+	// and published as PreKeyBundle.IdentityKey.
+	SigningPublic  [ed25519.PublicKeySize]byte
+	SigningPrivate ed25519.PrivateKey
+
+	// HasOneTimePreKey reports whether this party has published
+	// OneTimePreKeyPublic in its own PreKeyBundle.Keys. One-time prekeys are
+	// optional and, unlike SignedPreKeyPublic, meant to be consumed by the
+	// prekey server after a single use, so a party may have none published
+	// at any given moment.
+	HasOneTimePreKey bool
+	// OneTimePreKeyPublic/OneTimePreKeyPrivate are this party's one-time
+	// prekey, valid only when HasOneTimePreKey is true. X3DHExchange needs
+	// the private half whenever this party is the responder for a given
+	// exchange (see Run) and it has one published, since the initiator's
+	// DH4 term is computed against whichever one-time prekey it saw in this
+	// party's fetched bundle.
+	OneTimePreKeyPublic, OneTimePreKeyPrivate [32]byte
+}
+
+// x3dhHandshake is what each peer sends as the KeyExchange's kxBytes: their
+// long-term DH identity key, their long-term Ed25519 signing identity key, a
+// fresh ephemeral key, and a signature binding the signing key to the
+// account it'll be fetched from, so the meeting-place operator can't swap in
+// an identity for a different account.
+type x3dhHandshake struct {
+	DHIdentityKey []byte `json:"dhIdentityKey"`
+	SigningKey    []byte `json:"signingKey"`
+	EphemeralKey  []byte `json:"ephemeralKey"`
+	Signature     []byte `json:"signature"`
+}
+
+// X3DHExchange composes a KeyExchange with the prekey server's HTTP
+// endpoints to turn a PANDA-authenticated identity into a full X3DH session
+// key: once PANDA completes, each side fetches the other's PreKeyBundle,
+// verifies its SignedPreKey.Signature against the PANDA-authenticated
+// signing key, and combines the resulting Diffie-Hellman outputs into a
+// root key ready to feed a Double Ratchet.
+//
+// Unlike a plain X3DH handshake message, both sides run the same
+// KeyExchange and both fetch a bundle, so Run has to decide which of the two
+// plays the classic "initiator" (Alice) role, computing DH terms against
+// the peer's fetched bundle, and which plays "responder" (Bob), computing
+// the same terms from its own already-published prekey's private half
+// instead; see the role split in Run.
+type X3DHExchange struct {
+	KX *KeyExchange
+
+	// ServerURL is the prekey server's base URL, e.g.
+	// "https://example.org/prekeys". The recipientKeys endpoint is
+	// fetched at ServerURL + "/keys".
+	ServerURL string
+	// Username is this party's own account: it's bound into the
+	// handshake signature and decides the X3DH role (see Run). Password
+	// is sent with PeerUsername as the BasicAuth credentials when
+	// fetching the peer's bundle, since recipientKeys looks up the
+	// account named by the BasicAuth username; Username itself is never
+	// sent to the prekey server.
+	Username, Password string
+	// PeerUsername is the account the peer is expected to authenticate
+	// as. It's known out of band (the two parties already agreed on a
+	// shared secret to run PANDA at all), and is what the peer's
+	// handshake signature is checked against, so a prekey server or
+	// meeting-place operator can't substitute a different peer's
+	// identity without the signature failing to verify. It also decides
+	// which side plays the X3DH initiator role: see Run.
+	PeerUsername string
+
+	identity         X3DHIdentity
+	ephemeralPrivate [32]byte
+
+	// Client is the HTTP client used to fetch prekey bundles. It
+	// defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// NewX3DHExchange builds the identity/ephemeral handshake this party will
+// send as kxBytes and constructs the underlying KeyExchange around it.
+func NewX3DHExchange(rand io.Reader, meetingPlace MeetingPlace, sharedSecret *SharedSecret, serverURL, username, password, peerUsername string, identity X3DHIdentity) (*X3DHExchange, error) {
+	var ephemeralPrivate, ephemeralPublic [32]byte
+	if _, err := io.ReadFull(rand, ephemeralPrivate[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&ephemeralPublic, &ephemeralPrivate)
+
+	hs := x3dhHandshake{
+		DHIdentityKey: identity.DHPublic[:],
+		SigningKey:    identity.SigningPublic[:],
+		EphemeralKey:  ephemeralPublic[:],
+		Signature:     signIdentityBinding(identity.SigningPrivate, serverURL, username),
+	}
+	kxBytes, err := json.Marshal(&hs)
+	if err != nil {
+		return nil, err
+	}
+
+	kx, err := NewKeyExchange(rand, meetingPlace, sharedSecret, kxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return &X3DHExchange{
+		KX:               kx,
+		ServerURL:        serverURL,
+		Username:         username,
+		Password:         password,
+		PeerUsername:     peerUsername,
+		identity:         identity,
+		ephemeralPrivate: ephemeralPrivate,
+		Client:           http.DefaultClient,
+	}, nil
+}
+
+// identityBindingMessage is what signIdentityBinding/verifyIdentityBinding
+// sign and verify: the prekey server and the account username the signing
+// key is claimed to belong to. serverURL is length-prefixed rather than
+// joined with a delimiter, so that a "|" (or any other byte) inside
+// serverURL or username can't make two distinct (serverURL, username)
+// pairs sign the same message.
+func identityBindingMessage(serverURL, username string) []byte {
+	msg := make([]byte, 4+len(serverURL)+len(username))
+	binary.LittleEndian.PutUint32(msg, uint32(len(serverURL)))
+	copy(msg[4:], serverURL)
+	copy(msg[4+len(serverURL):], username)
+	return msg
+}
+
+// signIdentityBinding proves that signingPrivate's holder controls the
+// account reachable at serverURL/username, by signing that claim with the
+// signing key itself: unlike an HMAC keyed with public material, only the
+// private key's holder can produce this.
+func signIdentityBinding(signingPrivate ed25519.PrivateKey, serverURL, username string) []byte {
+	return ed25519.Sign(signingPrivate, identityBindingMessage(serverURL, username))
+}
+
+// verifyIdentityBinding checks a signature produced by signIdentityBinding.
+func verifyIdentityBinding(signingPublic []byte, serverURL, username string, signature []byte) bool {
+	if len(signingPublic) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(signingPublic), identityBindingMessage(serverURL, username), signature)
+}
+
+// Run drives the underlying KeyExchange to completion, then fetches and
+// verifies the peer's prekey bundle and derives the X3DH session key.
+func (x *X3DHExchange) Run() (*SessionKeys, error) {
+	reply, err := x.KX.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	var peer x3dhHandshake
+	if err := json.Unmarshal(reply, &peer); err != nil {
+		return nil, errors.New("panda: x3dh: malformed peer handshake: " + err.Error())
+	}
+	if len(peer.DHIdentityKey) != 32 || len(peer.SigningKey) != ed25519.PublicKeySize || len(peer.EphemeralKey) != 32 {
+		return nil, errors.New("panda: x3dh: peer handshake has the wrong key length")
+	}
+	if !verifyIdentityBinding(peer.SigningKey, x.ServerURL, x.PeerUsername, peer.Signature) {
+		return nil, errors.New("panda: x3dh: peer's identity binding does not verify")
+	}
+
+	var peerDHIdentity, peerEphemeral [32]byte
+	copy(peerDHIdentity[:], peer.DHIdentityKey)
+	copy(peerEphemeral[:], peer.EphemeralKey)
+	var peerSigningKey [ed25519.PublicKeySize]byte
+	copy(peerSigningKey[:], peer.SigningKey)
+
+	bundle, err := x.fetchPeerPreKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyPreKeyBundle(peerSigningKey, bundle); err != nil {
+		return nil, err
+	}
+
+	// Both sides run the same KeyExchange and both fetch a bundle, so one
+	// of them has to play the X3DH initiator (Alice) role - computing its
+	// DH terms against the peer's fetched SignedPreKey - and the other the
+	// responder (Bob) role - computing the same terms from its own
+	// already-published SignedPreKey's private half instead. Username
+	// order gives both sides the same answer without any extra
+	// negotiation.
+	isInitiator := x.Username < x.PeerUsername
+
+	rootKey, err := deriveX3DHRootKey(isInitiator, x.identity, x.ephemeralPrivate, peerDHIdentity, peerEphemeral, bundle)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SessionKeys{RootKey: rootKey, PeerIdentity: peerSigningKey}, nil
+}
+
+// fetchPeerPreKeys retrieves the peer's prekey bundle from the prekey
+// server's recipientKeys endpoint.
+func (x *X3DHExchange) fetchPeerPreKeys() (*PreKeyBundle, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(x.ServerURL, "/")+"/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(x.PeerUsername, x.Password)
+
+	client := x.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("panda: x3dh: prekey server returned %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundle PreKeyBundle
+	if err := json.Unmarshal(body, &bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// verifyPreKeyBundle checks that bundle.SignedPreKey.Signature verifies
+// against peerSigningKey - the Ed25519 signing key PANDA just authenticated
+// - rather than against bundle.IdentityKey, so a prekey server cannot
+// substitute a different identity for the one the peer proved ownership of.
+func verifyPreKeyBundle(peerSigningKey [ed25519.PublicKeySize]byte, bundle *PreKeyBundle) error {
+	signedPub, err := base64.StdEncoding.DecodeString(bundle.SignedPreKey.PublicKey)
+	if err != nil {
+		return errors.New("panda: x3dh: malformed signed prekey: " + err.Error())
+	}
+	signature, err := base64.StdEncoding.DecodeString(bundle.SignedPreKey.Signature)
+	if err != nil {
+		return errors.New("panda: x3dh: malformed signed prekey signature: " + err.Error())
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(peerSigningKey[:]), signedPub, signature) {
+		return errors.New("panda: x3dh: signed prekey signature does not verify")
+	}
+	return nil
+}
+
+// deriveX3DHRootKey computes the X3DH Diffie-Hellman outputs and combines
+// them with HKDF into a 32-byte root key.
+//
+// The initiator computes DH1 (its identity key, the peer's fetched signed
+// prekey), DH2 (its ephemeral, the peer's identity key) and DH3 (its
+// ephemeral, the peer's fetched signed prekey), plus DH4 (its ephemeral, the
+// peer's one-time prekey) when the fetched bundle still has one available.
+// The responder computes the same three DH values from the other side: DH1
+// (its own signed prekey's private half, the peer's identity key), DH2 (its
+// identity key, the peer's ephemeral) and DH3 (its own signed prekey's
+// private half, the peer's ephemeral) - which, because Diffie-Hellman is
+// commutative, land on exactly the same points as the initiator's DH1-DH3,
+// so both sides feed HKDF the same input material. DH4's responder-side
+// analogue is its own one-time prekey's private half against the peer's
+// ephemeral - computed only when identity.HasOneTimePreKey, which must agree
+// with whether the initiator saw a one-time prekey in this party's published
+// bundle (bundle.Keys), or the two sides derive different root keys.
+func deriveX3DHRootKey(isInitiator bool, identity X3DHIdentity, ephemeralPrivate, peerDHIdentity, peerEphemeral [32]byte, bundle *PreKeyBundle) ([32]byte, error) {
+	var rootKey [32]byte
+
+	peerSignedPreKey, err := decodeCurve25519Key(bundle.SignedPreKey.PublicKey)
+	if err != nil {
+		return rootKey, err
+	}
+
+	var dh1, dh2, dh3 [32]byte
+	var ikm bytes.Buffer
+
+	if isInitiator {
+		curve25519.ScalarMult(&dh1, &identity.DHPrivate, &peerSignedPreKey)
+		curve25519.ScalarMult(&dh2, &ephemeralPrivate, &peerDHIdentity)
+		curve25519.ScalarMult(&dh3, &ephemeralPrivate, &peerSignedPreKey)
+		ikm.Write(dh1[:])
+		ikm.Write(dh2[:])
+		ikm.Write(dh3[:])
+
+		if len(bundle.Keys) > 0 {
+			peerOneTimePreKey, err := decodeCurve25519Key(bundle.Keys[0].PublicKey)
+			if err != nil {
+				return rootKey, err
+			}
+			var dh4 [32]byte
+			curve25519.ScalarMult(&dh4, &ephemeralPrivate, &peerOneTimePreKey)
+			ikm.Write(dh4[:])
+		}
+	} else {
+		curve25519.ScalarMult(&dh1, &identity.SignedPreKeyPrivate, &peerDHIdentity)
+		curve25519.ScalarMult(&dh2, &identity.DHPrivate, &peerEphemeral)
+		curve25519.ScalarMult(&dh3, &identity.SignedPreKeyPrivate, &peerEphemeral)
+		ikm.Write(dh1[:])
+		ikm.Write(dh2[:])
+		ikm.Write(dh3[:])
+
+		if identity.HasOneTimePreKey {
+			var dh4 [32]byte
+			curve25519.ScalarMult(&dh4, &identity.OneTimePreKeyPrivate, &peerEphemeral)
+			ikm.Write(dh4[:])
+		}
+	}
+
+	h := hkdf.New(sha256.New, ikm.Bytes(), nil, []byte("X3DH PANDA root key"))
+	if _, err := io.ReadFull(h, rootKey[:]); err != nil {
+		return rootKey, err
+	}
+	return rootKey, nil
+}
+
+func decodeCurve25519Key(s string) ([32]byte, error) {
+	var key [32]byte
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(raw) != 32 {
+		return key, errors.New("panda: x3dh: key has the wrong length")
+	}
+	copy(key[:], raw)
+	return key, nil
+}
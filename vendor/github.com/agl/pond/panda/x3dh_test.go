@@ -0,0 +1,282 @@
+package panda
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+var errShutdown = errors.New("panda: rendezvous meeting place shut down")
+
+// rendezvousMeetingPlace is a minimal in-memory MeetingPlace: the first
+// caller for a given id blocks until a second caller arrives with the same
+// id, then each receives the other's message. It's only useful for tests
+// that drive exactly two peers through a single exchange each.
+type rendezvousMeetingPlace struct {
+	padding int
+
+	mu     sync.Mutex
+	waitng map[string]*rendezvous
+}
+
+type rendezvous struct {
+	message []byte
+	done    chan []byte
+}
+
+func newRendezvousMeetingPlace(padding int) *rendezvousMeetingPlace {
+	return &rendezvousMeetingPlace{padding: padding, waitng: make(map[string]*rendezvous)}
+}
+
+func (r *rendezvousMeetingPlace) Padding() int { return r.padding }
+
+func (r *rendezvousMeetingPlace) Exchange(log func(string, ...interface{}), id, message []byte, shutdown chan struct{}) ([]byte, error) {
+	key := string(id)
+
+	r.mu.Lock()
+	other, ok := r.waitng[key]
+	if !ok {
+		other = &rendezvous{message: message, done: make(chan []byte, 1)}
+		r.waitng[key] = other
+		r.mu.Unlock()
+
+		select {
+		case peerMessage := <-other.done:
+			return peerMessage, nil
+		case <-shutdown:
+			return nil, errShutdown
+		}
+	}
+	delete(r.waitng, key)
+	r.mu.Unlock()
+
+	other.done <- message
+	return other.message, nil
+}
+
+// x3dhTestPeer is one side of the round-trip test: its long-term identity
+// and the bundle it publishes to the fake prekey server.
+type x3dhTestPeer struct {
+	username string
+	identity X3DHIdentity
+	bundle   PreKeyBundle
+}
+
+func newX3DHTestPeer(t *testing.T, username string) x3dhTestPeer {
+	t.Helper()
+
+	var identity X3DHIdentity
+	if _, err := rand.Read(identity.DHPrivate[:]); err != nil {
+		t.Fatal(err)
+	}
+	curve25519.ScalarBaseMult(&identity.DHPublic, &identity.DHPrivate)
+
+	if _, err := rand.Read(identity.SignedPreKeyPrivate[:]); err != nil {
+		t.Fatal(err)
+	}
+	curve25519.ScalarBaseMult(&identity.SignedPreKeyPublic, &identity.SignedPreKeyPrivate)
+
+	signingPub, signingPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(identity.SigningPublic[:], signingPub)
+	identity.SigningPrivate = signingPriv
+
+	signature := ed25519.Sign(signingPriv, identity.SignedPreKeyPublic[:])
+
+	return x3dhTestPeer{
+		username: username,
+		identity: identity,
+		bundle: PreKeyBundle{
+			IdentityKey: base64.StdEncoding.EncodeToString(signingPub),
+			SignedPreKey: SignedPreKey{
+				PublicKey: base64.StdEncoding.EncodeToString(identity.SignedPreKeyPublic[:]),
+				Signature: base64.StdEncoding.EncodeToString(signature),
+			},
+		},
+	}
+}
+
+// withOneTimePreKey returns a copy of peer that has published a one-time
+// prekey in its bundle, exercising the X3DH DH4 term that newX3DHTestPeer's
+// bundles otherwise leave empty.
+func withOneTimePreKey(t *testing.T, peer x3dhTestPeer) x3dhTestPeer {
+	t.Helper()
+
+	var priv, pub [32]byte
+	if _, err := rand.Read(priv[:]); err != nil {
+		t.Fatal(err)
+	}
+	curve25519.ScalarBaseMult(&pub, &priv)
+
+	peer.identity.HasOneTimePreKey = true
+	peer.identity.OneTimePreKeyPrivate = priv
+	peer.identity.OneTimePreKeyPublic = pub
+	peer.bundle.Keys = []PreKey{{
+		PublicKey: base64.StdEncoding.EncodeToString(pub[:]),
+	}}
+	return peer
+}
+
+// newPreKeyServer serves each peer's bundle at GET /keys, keyed by the
+// BasicAuth username - matching how fetchPeerPreKeys addresses the
+// recipientKeys endpoint by the account whose keys it wants.
+func newPreKeyServer(t *testing.T, peers ...x3dhTestPeer) *httptest.Server {
+	t.Helper()
+	bundles := make(map[string]PreKeyBundle, len(peers))
+	for _, p := range peers {
+		bundles[p.username] = p.bundle
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		uname, _, ok := req.BasicAuth()
+		bundle, known := bundles[uname]
+		if !ok || !known {
+			http.Error(w, "unknown user", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(&bundle)
+	}))
+}
+
+func runX3DHExchange(t *testing.T, result chan<- *SessionKeys, meetingPlace MeetingPlace, sharedSecret *SharedSecret, serverURL string, self, peer x3dhTestPeer) {
+	t.Helper()
+	x, err := NewX3DHExchange(rand.Reader, meetingPlace, sharedSecret, serverURL, self.username, "password", peer.username, self.identity)
+	if err != nil {
+		t.Errorf("NewX3DHExchange(%s): %s", self.username, err)
+		result <- nil
+		return
+	}
+	x.KX.Testing = true
+
+	keys, err := x.Run()
+	if err != nil {
+		t.Errorf("X3DHExchange.Run(%s): %s", self.username, err)
+		result <- nil
+		return
+	}
+	result <- keys
+}
+
+func TestX3DHExchangeRoundTrip(t *testing.T) {
+	alice := newX3DHTestPeer(t, "alice")
+	bob := newX3DHTestPeer(t, "bob")
+
+	server := newPreKeyServer(t, alice, bob)
+	defer server.Close()
+
+	meetingPlace := newRendezvousMeetingPlace(4096)
+	sharedSecret := &SharedSecret{Secret: "correct horse battery staple"}
+
+	aliceResult := make(chan *SessionKeys, 1)
+	bobResult := make(chan *SessionKeys, 1)
+
+	go runX3DHExchange(t, aliceResult, meetingPlace, sharedSecret, server.URL, alice, bob)
+	go runX3DHExchange(t, bobResult, meetingPlace, sharedSecret, server.URL, bob, alice)
+
+	aliceKeys := <-aliceResult
+	bobKeys := <-bobResult
+	if aliceKeys == nil || bobKeys == nil {
+		t.Fatal("one side of the exchange failed (see errors above)")
+	}
+
+	if aliceKeys.RootKey != bobKeys.RootKey {
+		t.Fatalf("root keys differ: alice %x, bob %x", aliceKeys.RootKey, bobKeys.RootKey)
+	}
+	if aliceKeys.PeerIdentity != bob.identity.SigningPublic {
+		t.Fatalf("alice's view of bob's signing key is wrong")
+	}
+	if bobKeys.PeerIdentity != alice.identity.SigningPublic {
+		t.Fatalf("bob's view of alice's signing key is wrong")
+	}
+}
+
+func TestX3DHExchangeRoundTripWithOneTimePreKey(t *testing.T) {
+	alice := newX3DHTestPeer(t, "alice")
+	bob := withOneTimePreKey(t, newX3DHTestPeer(t, "bob"))
+
+	server := newPreKeyServer(t, alice, bob)
+	defer server.Close()
+
+	meetingPlace := newRendezvousMeetingPlace(4096)
+	sharedSecret := &SharedSecret{Secret: "correct horse battery staple"}
+
+	aliceResult := make(chan *SessionKeys, 1)
+	bobResult := make(chan *SessionKeys, 1)
+
+	go runX3DHExchange(t, aliceResult, meetingPlace, sharedSecret, server.URL, alice, bob)
+	go runX3DHExchange(t, bobResult, meetingPlace, sharedSecret, server.URL, bob, alice)
+
+	aliceKeys := <-aliceResult
+	bobKeys := <-bobResult
+	if aliceKeys == nil || bobKeys == nil {
+		t.Fatal("one side of the exchange failed (see errors above)")
+	}
+
+	if aliceKeys.RootKey != bobKeys.RootKey {
+		t.Fatalf("root keys differ with a one-time prekey in play: alice %x, bob %x", aliceKeys.RootKey, bobKeys.RootKey)
+	}
+}
+
+func TestX3DHExchangeRejectsForgedSigningKey(t *testing.T) {
+	alice := newX3DHTestPeer(t, "alice")
+	bob := newX3DHTestPeer(t, "bob")
+	mallory := newX3DHTestPeer(t, "mallory")
+
+	// Bob's published bundle is signed by mallory's key rather than his
+	// own, simulating a prekey server that substituted a different
+	// identity than the one PANDA authenticated.
+	forgedBob := bob
+	forgedBob.bundle = mallory.bundle
+
+	server := newPreKeyServer(t, alice, forgedBob)
+	defer server.Close()
+
+	meetingPlace := newRendezvousMeetingPlace(4096)
+	sharedSecret := &SharedSecret{Secret: "correct horse battery staple"}
+
+	x, err := NewX3DHExchange(rand.Reader, meetingPlace, sharedSecret, server.URL, alice.username, "password", bob.username, alice.identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.KX.Testing = true
+
+	done := make(chan struct{})
+	go func() {
+		bobX, err := NewX3DHExchange(rand.Reader, meetingPlace, sharedSecret, server.URL, bob.username, "password", alice.username, bob.identity)
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		bobX.KX.Testing = true
+		bobX.Run()
+		close(done)
+	}()
+
+	if _, err := x.Run(); err == nil {
+		t.Fatal("Run succeeded despite bob's bundle being signed by the wrong key")
+	}
+	<-done
+}
+
+func TestIdentityBindingMessageIsUnambiguous(t *testing.T) {
+	// "server|" + "a" and "server" + "|a" would collide under a bare "|"
+	// delimiter even though they're distinct (serverURL, username)
+	// pairs; length-prefixing serverURL must keep them apart.
+	a := identityBindingMessage("server|", "a")
+	b := identityBindingMessage("server", "|a")
+	if bytes.Equal(a, b) {
+		t.Fatalf("identityBindingMessage(%q, %q) collided with identityBindingMessage(%q, %q)",
+			"server|", "a", "server", "|a")
+	}
+}